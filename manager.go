@@ -0,0 +1,131 @@
+package urlcache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Spec describes a single cache to register with a Manager.
+type Spec struct {
+	// URL is the origin to cache.
+	URL string
+
+	// Dir is the sub-directory, resolved under the Manager's root
+	// directory, in which this cache's entry is stored.
+	Dir string
+
+	// CheckInterval is how often to poll URL for changes. Zero uses
+	// Open's default.
+	CheckInterval time.Duration
+
+	// MaxAge is how long an on-disk entry may sit unrefreshed before it's
+	// treated as missing: instead of being handed to OnUpdate, it's
+	// discarded and re-downloaded from scratch. Zero means entries never
+	// expire this way.
+	MaxAge time.Duration
+
+	// OnUpdate is called whenever initial or updated data is available.
+	OnUpdate func(io.Reader) error
+
+	// Options are passed through to Open when this cache is registered.
+	Options []Option
+}
+
+// Manager is a consolidated store for many named urlcaches, each backed by
+// its own file under a shared root directory. It's modeled on Hugo's
+// consolidated file cache: rather than every caller of urlcache wiring up
+// its own directory and polling policy, a Manager lets an app register
+// dozens of remote lists up front and look them up by name.
+type Manager struct {
+	rootDir string
+
+	mu     sync.RWMutex
+	caches map[string]*managedCache
+}
+
+type managedCache struct {
+	cache     *Cache
+	cacheFile string
+	maxAge    time.Duration
+}
+
+// NewManager creates a Manager whose caches are all stored under rootDir.
+func NewManager(rootDir string) *Manager {
+	return &Manager{rootDir: rootDir, caches: make(map[string]*managedCache)}
+}
+
+// Register opens a cache for spec and makes it available under name via
+// Get. It's an error to register the same name twice.
+func (m *Manager) Register(name string, spec Spec) (*Cache, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.caches[name]; found {
+		return nil, fmt.Errorf("cache %v is already registered", name)
+	}
+
+	cacheFile := filepath.Join(m.rootDir, spec.Dir, name)
+	if spec.MaxAge > 0 {
+		if err := expireIfStale(cacheFile, spec.MaxAge); err != nil {
+			return nil, fmt.Errorf("Unable to check staleness of %v: %v", cacheFile, err)
+		}
+	}
+
+	cache, err := Open(spec.URL, cacheFile, spec.CheckInterval, spec.OnUpdate, spec.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	m.caches[name] = &managedCache{cache: cache, cacheFile: cacheFile, maxAge: spec.MaxAge}
+	return cache, nil
+}
+
+// Get returns the cache registered under name, or nil if nothing has been
+// registered under that name.
+func (m *Manager) Get(name string) *Cache {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	managed, found := m.caches[name]
+	if !found {
+		return nil
+	}
+	return managed.cache
+}
+
+// Prune walks the Manager's registered caches and removes the on-disk
+// entry of any whose MaxAge has elapsed since it was last refreshed.
+func (m *Manager) Prune() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for name, managed := range m.caches {
+		if managed.maxAge <= 0 {
+			continue
+		}
+		if err := expireIfStale(managed.cacheFile, managed.maxAge); err != nil {
+			return fmt.Errorf("Unable to prune %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// expireIfStale removes the entry stored at cacheFile if it's older than
+// maxAge, so that the next readInitial treats it as missing rather than
+// handing stale data to onUpdate.
+func expireIfStale(cacheFile string, maxAge time.Duration) error {
+	info, err := os.Stat(cacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if time.Since(info.ModTime()) <= maxAge {
+		return nil
+	}
+	return deleteFile(cacheFile)
+}
@@ -0,0 +1,106 @@
+package urlcache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagerRegisterAndGet(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_manager_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	lastRead := ""
+
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer s.Close()
+
+	m := NewManager(tmpDir)
+	cache, err := m.Register("greeting", Spec{
+		URL:           s.URL,
+		Dir:           "lists",
+		CheckInterval: 20 * time.Millisecond,
+		OnUpdate: func(r io.Reader) error {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			mx.Lock()
+			lastRead = string(b)
+			mx.Unlock()
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cache.Close()
+
+	assert.Same(t, cache, m.Get("greeting"))
+	assert.Nil(t, m.Get("nonexistent"))
+
+	_, err = m.Register("greeting", Spec{URL: s.URL})
+	assert.Error(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, "hello", lastRead)
+}
+
+func TestManagerPrune(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_manager_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cacheFile := filepath.Join(tmpDir, "lists", "stale")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(cacheFile), 0755))
+	assert.NoError(t, ioutil.WriteFile(cacheFile, []byte("old data"), 0644))
+	oldTime := time.Now().Add(-1 * time.Hour)
+	assert.NoError(t, os.Chtimes(cacheFile, oldTime, oldTime))
+
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("new data"))
+	}))
+	defer s.Close()
+
+	m := NewManager(tmpDir)
+	cache, err := m.Register("stale", Spec{
+		URL:           s.URL,
+		Dir:           "lists",
+		CheckInterval: time.Hour,
+		MaxAge:        10 * time.Millisecond,
+		OnUpdate:      func(r io.Reader) error { return nil },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cache.Close()
+
+	// Registering with an already-stale entry should have discarded it
+	// rather than handing it to onUpdate.
+	_, err = os.Stat(cacheFile)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, ioutil.WriteFile(cacheFile, []byte("old data"), 0644))
+	assert.NoError(t, os.Chtimes(cacheFile, oldTime, oldTime))
+	assert.NoError(t, m.Prune())
+	_, err = os.Stat(cacheFile)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,91 @@
+package urlcache
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how updateFromWeb retries transient failures:
+// network errors and 5xx/429 responses from the origin.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made for one
+	// revalidation, including the first. Values <= 0 are treated as 1 (no
+	// retries).
+	MaxAttempts int
+
+	// InitialDelay is how long to wait before the first retry.
+	InitialDelay time.Duration
+
+	// Multiplier is applied to the delay after each subsequent retry.
+	Multiplier float64
+
+	// MaxDelay caps the computed delay, before jitter is applied. Zero
+	// means no cap.
+	MaxDelay time.Duration
+
+	// JitterFraction randomizes each computed delay by up to this
+	// fraction in either direction, to avoid many clients retrying in
+	// lockstep. E.g. 0.2 means +/-20%.
+	JitterFraction float64
+}
+
+// defaultRetryPolicy is used when no RetryPolicy option is given to Open.
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialDelay:   500 * time.Millisecond,
+	Multiplier:     2,
+	MaxDelay:       30 * time.Second,
+	JitterFraction: 0.2,
+}
+
+// WithRetryPolicy makes Open retry transient failures per policy instead of
+// waiting for the next scheduled checkInterval.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *urlcache) {
+		c.retryPolicy = policy
+	}
+}
+
+// delay computes how long to wait before retry number attempt (0-based: the
+// first retry, after the initial attempt, is attempt 0).
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.JitterFraction > 0 {
+		jitter := d * p.JitterFraction
+		d += (rand.Float64()*2 - 1) * jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// parseRetryAfter extracts the origin-requested retry delay from a
+// response's Retry-After header, which per RFC 7231 may be either a number
+// of seconds or an HTTP date.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// isRetryableStatus reports whether statusCode is a transient failure
+// worth retrying (5xx, or 429 Too Many Requests), as opposed to a
+// non-retryable client error.
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
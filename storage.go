@@ -0,0 +1,237 @@
+package urlcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Metadata captures the cache-validation information associated with a
+// stored entry, as last seen in a response from the origin.
+type Metadata struct {
+	ETag         string
+	LastModified string
+	// Vary holds the (canonicalized) header names from the response's Vary
+	// header, if any, that were used to derive the storage key this entry
+	// was actually stored under.
+	Vary []string
+}
+
+// Storage is a pluggable backend for persisting cached entries. Open uses
+// it to read and write the cached data for a url, keyed by a cache key
+// derived from that url.
+type Storage interface {
+	// Get returns the previously-stored data and Metadata for key. It
+	// returns an error satisfying os.IsNotExist when nothing has been
+	// stored for key yet.
+	Get(key string) (io.ReadCloser, Metadata, error)
+
+	// Put stores data and its associated Metadata under key, replacing
+	// whatever was previously stored there.
+	Put(key string, data []byte, meta Metadata) error
+
+	// Delete removes whatever is stored under key, if anything.
+	Delete(key string) error
+
+	// Touch marks key as having just been successfully revalidated, without
+	// changing its stored data or Metadata. It's called after a 304 Not
+	// Modified, which confirms an entry is still valid but has no new data
+	// to Put, so that anything tracking staleness from the entry's last
+	// write (e.g. Manager's MaxAge) counts that revalidation.
+	Touch(key string) error
+}
+
+// FileStorage is the historical Storage backend: a single entry backed by a
+// single file on disk, with writes made atomically via a temp file and
+// rename. It ignores the key passed to Get/Put/Delete, since it only ever
+// holds one entry.
+type FileStorage struct {
+	path string
+}
+
+// NewFileStorage creates a FileStorage that persists its single entry at
+// path.
+func NewFileStorage(path string) *FileStorage {
+	return &FileStorage{path: path}
+}
+
+func (s *FileStorage) Get(key string) (io.ReadCloser, Metadata, error) {
+	return getFile(s.path)
+}
+
+func (s *FileStorage) Put(key string, data []byte, meta Metadata) error {
+	return putFile(s.path, data, meta)
+}
+
+func (s *FileStorage) Delete(key string) error {
+	return deleteFile(s.path)
+}
+
+func (s *FileStorage) Touch(key string) error {
+	return touchFile(s.path)
+}
+
+// DirStorage is a Storage backend that keeps many entries under a single
+// root directory, one file (plus a metadata sidecar) per cache key, so that
+// one process can share a single backend across many cached urls.
+type DirStorage struct {
+	dir string
+}
+
+// NewDirStorage creates a DirStorage rooted at dir.
+func NewDirStorage(dir string) *DirStorage {
+	return &DirStorage{dir: dir}
+}
+
+func (s *DirStorage) Get(key string) (io.ReadCloser, Metadata, error) {
+	return getFile(s.entryPath(key))
+}
+
+func (s *DirStorage) Put(key string, data []byte, meta Metadata) error {
+	return putFile(s.entryPath(key), data, meta)
+}
+
+func (s *DirStorage) Delete(key string) error {
+	return deleteFile(s.entryPath(key))
+}
+
+func (s *DirStorage) Touch(key string) error {
+	return touchFile(s.entryPath(key))
+}
+
+// entryPath maps key to a file name under dir, hashing it so that keys
+// containing characters unsafe for file names (e.g. full urls) are handled
+// uniformly.
+func (s *DirStorage) entryPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// MemStorage is an in-memory Storage backend. It's primarily intended for
+// tests, where persisting to disk just slows things down.
+type MemStorage struct {
+	mx      sync.RWMutex
+	entries map[string]memEntry
+}
+
+type memEntry struct {
+	data []byte
+	meta Metadata
+}
+
+// NewMemStorage creates an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{entries: make(map[string]memEntry)}
+}
+
+func (s *MemStorage) Get(key string) (io.ReadCloser, Metadata, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	entry, found := s.entries[key]
+	if !found {
+		return nil, Metadata{}, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(entry.data)), entry.meta, nil
+}
+
+func (s *MemStorage) Put(key string, data []byte, meta Metadata) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.entries[key] = memEntry{data: data, meta: meta}
+	return nil
+}
+
+func (s *MemStorage) Delete(key string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Touch is a no-op for MemStorage: it has no on-disk mtime for anything to
+// track, and an in-memory entry doesn't outlive the process that revalidated
+// it anyway.
+func (s *MemStorage) Touch(key string) error {
+	return nil
+}
+
+// getFile reads the data and metadata sidecar stored at path.
+func getFile(path string) (io.ReadCloser, Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	meta, _ := readMeta(metaPath(path))
+	return f, meta, nil
+}
+
+// putFile writes data to path via a temp file and rename, so that readers
+// never see a partially-written file, and writes meta to path's sidecar.
+func putFile(path string, data []byte, meta Metadata) error {
+	dir, _ := filepath.Split(path)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Unable to create cache dir %v: %v", dir, err)
+		}
+	}
+
+	tmpName := fmt.Sprintf("%v_temp", path)
+	if err := ioutil.WriteFile(tmpName, data, 0644); err != nil {
+		return fmt.Errorf("Unable to write temp file %v: %v", tmpName, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("Unable to move tmp file to %v: %v", path, err)
+	}
+	if err := writeMeta(metaPath(path), meta); err != nil {
+		return fmt.Errorf("Unable to write metadata for %v: %v", path, err)
+	}
+	return nil
+}
+
+// touchFile sets path's mtime to now, so that staleness tracking keyed off
+// it (e.g. Manager's MaxAge) sees a revalidation that didn't change the
+// file's contents.
+func touchFile(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+func deleteFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(metaPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func metaPath(path string) string {
+	return path + ".meta"
+}
+
+func readMeta(path string) (Metadata, error) {
+	var meta Metadata
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+func writeMeta(path string, meta Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
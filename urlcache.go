@@ -3,14 +3,15 @@
 package urlcache
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/getlantern/zaplog"
@@ -22,20 +23,56 @@ var (
 	defaultCheckInterval = 1 * time.Minute
 )
 
+// Option customizes the behavior of Open.
+type Option func(*urlcache)
+
+// Strict opts into strict RFC 7234 freshness semantics: instead of always
+// polling every checkInterval, the next revalidation is scheduled for the
+// freshness lifetime computed from the most recently seen
+// Cache-Control/Expires headers, and the conditional GET is skipped
+// entirely for any wake that lands before the cached response goes stale.
+// The loop still wakes at most every checkInterval and reports the pending
+// schedule to OnSchedule again, but those early wakes never touch the network.
+func Strict() Option {
+	return func(c *urlcache) {
+		c.strict = true
+	}
+}
+
+// OnSchedule registers a callback that's invoked with the time of the next
+// scheduled revalidation every time it's (re)computed, so callers can
+// observe when urlcache expects to next hit the network.
+func OnSchedule(onSchedule func(next time.Time)) Option {
+	return func(c *urlcache) {
+		c.onSchedule = onSchedule
+	}
+}
+
+// WithStorage makes Open persist through storage instead of the default
+// single-file on-disk backend, keyed by key. This is how multiple urls can
+// share one Storage (e.g. a DirStorage).
+func WithStorage(storage Storage, key string) Option {
+	return func(c *urlcache) {
+		c.storage = storage
+		c.cacheKey = key
+	}
+}
+
 // Open opens the url and starts caching in cacheFile. Whenever initial or
 // updated data is available, onupdate is called. If data already existed in
-// cacheFile, onUpdate will be immediately called with that.
-func Open(url string, cacheFile string, checkInterval time.Duration, onUpdate func(io.Reader) error) error {
+// cacheFile, onUpdate will be immediately called with that. It's equivalent
+// to calling OpenContext with context.Background().
+func Open(url string, cacheFile string, checkInterval time.Duration, onUpdate func(io.Reader) error, opts ...Option) (*Cache, error) {
+	return OpenContext(context.Background(), url, cacheFile, checkInterval, onUpdate, opts...)
+}
+
+// OpenContext is like Open, except that canceling ctx has the same effect as
+// calling Close on the returned Cache: the refresh loop stops and any
+// in-flight request to the origin is aborted.
+func OpenContext(ctx context.Context, url string, cacheFile string, checkInterval time.Duration, onUpdate func(io.Reader) error, opts ...Option) (*Cache, error) {
 	if checkInterval <= 0 {
 		checkInterval = defaultCheckInterval
 	}
-	dir, _ := filepath.Split(cacheFile)
-	if dir != "" {
-		err := os.MkdirAll(dir, 0755)
-		if err != nil && !os.IsExist(err) {
-			return fmt.Errorf("Unable to create cache dir %v: %v", dir, err)
-		}
-	}
 
 	c := &urlcache{
 		url:           url,
@@ -44,141 +81,336 @@ func Open(url string, cacheFile string, checkInterval time.Duration, onUpdate fu
 		onUpdate:      onUpdate,
 		client:        &http.Client{},
 	}
-	go c.keepCurrent(c.readInitial())
+	c.retryPolicy = defaultRetryPolicy
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.storage == nil {
+		c.storage = NewFileStorage(cacheFile)
+		c.cacheKey = cacheFile
+	}
+
+	initialMeta := c.readInitial()
+	c.validators = &validators{etag: initialMeta.ETag, lastModified: initialMeta.LastModified}
+
+	cacheCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go c.keepCurrent(cacheCtx, done)
 
+	return &Cache{c: c, cancel: cancel, done: done}, nil
+}
+
+// Cache is a handle on a cache opened with Open or OpenContext.
+type Cache struct {
+	c      *urlcache
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close stops refreshing the cache, aborting the background loop's
+// revalidation request if one is in flight, and waits for the loop to exit.
+// A ForceRefresh in progress runs under its own ctx and is not aborted by
+// Close.
+func (cache *Cache) Close() error {
+	cache.cancel()
+	<-cache.done
 	return nil
 }
 
+// ForceRefresh triggers an out-of-band revalidation against the origin and
+// reports its outcome synchronously, rather than waiting for the next
+// scheduled check.
+func (cache *Cache) ForceRefresh(ctx context.Context) error {
+	return cache.c.forceRefresh(ctx)
+}
+
+// LastSuccess returns the time of the most recent successful revalidation
+// (including one that found the cache still fresh via a 304), or the zero
+// Time if none has succeeded yet.
+func (cache *Cache) LastSuccess() time.Time {
+	cache.c.healthMu.Lock()
+	defer cache.c.healthMu.Unlock()
+	return cache.c.lastSuccess
+}
+
+// LastError returns the error from the most recent revalidation attempt,
+// or nil if that attempt succeeded.
+func (cache *Cache) LastError() error {
+	cache.c.healthMu.Lock()
+	defer cache.c.healthMu.Unlock()
+	return cache.c.lastErr
+}
+
 type urlcache struct {
 	url           string
 	cacheFile     string
 	checkInterval time.Duration
 	onUpdate      func(io.Reader) error
 	client        *http.Client
+
+	storage  Storage
+	cacheKey string
+
+	strict      bool
+	onSchedule  func(next time.Time)
+	retryPolicy RetryPolicy
+
+	// mu serializes revalidation attempts and guards validators/next. It's
+	// held across the origin round-trip (including retry backoff sleeps) by
+	// design, since only one revalidation should be in flight at a time.
+	mu         sync.Mutex
+	validators *validators
+	next       time.Time
+
+	// healthMu guards lastSuccess/lastErr separately from mu, so LastSuccess
+	// and LastError can report health without blocking on an in-flight
+	// revalidation.
+	healthMu    sync.Mutex
+	lastSuccess time.Time
+	lastErr     error
 }
 
-func (c *urlcache) readInitial() time.Time {
-	var currentDate time.Time
-	file, err := os.Open(c.cacheFile)
+func (c *urlcache) readInitial() Metadata {
+	rc, meta, err := c.storage.Get(c.cacheKey)
 	if err == nil {
-		err = c.onUpdate(bufio.NewReader(file))
-		file.Close()
-		if err == nil {
-			fileInfo, err := file.Stat()
-			if err == nil {
-				log.Infof("Successfully initialized from %v", c.cacheFile)
-				currentDate = fileInfo.ModTime()
-			}
+		defer rc.Close()
+		if err := c.onUpdate(rc); err == nil {
+			log.Infof("Successfully initialized from %v", c.cacheKey)
 		}
 	}
 
-	return currentDate
+	return meta
 }
 
-func (c *urlcache) keepCurrent(initialDate time.Time) {
-	var scheme cacheScheme
+func (c *urlcache) keepCurrent(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	next := time.Now()
 	for {
-		scheme = c.checkUpdates(initialDate, scheme)
-		time.Sleep(c.checkInterval)
-	}
-}
+		if c.strict && time.Now().Before(next) {
+			// The last response told us it's still fresh; don't bother
+			// issuing a conditional GET until it's due to be revalidated.
+			// Still wake at most every checkInterval, reporting the pending
+			// schedule to OnSchedule again each time.
+			c.scheduleNext(next)
+			if !c.sleepOrDone(ctx, c.wakeTime(next)) {
+				return
+			}
+			continue
+		}
 
-func (c *urlcache) checkUpdates(initialDate time.Time, scheme cacheScheme) cacheScheme {
-	if scheme == nil {
-		log.Infof("Cache scheme unknown, issue HEAD request to determine scheme")
-		headResp, err := http.Head(c.url)
-		if err != nil {
-			log.Errorf("Unable to request modified of %v: %v", c.url, err)
-			return scheme
+		if err := c.forceRefresh(ctx); err != nil {
+			log.Errorf("Unable to update from web: %v", err)
 		}
 
-		if headResp.Header.Get(lastModifiedHeader) != "" {
-			log.Infof("Will use %v to determine when file changes", lastModifiedHeader)
-			scheme = &lastModifiedScheme{initialDate.Format(http.TimeFormat)}
-		} else if headResp.Header.Get(etagHeader) != "" {
-			log.Infof("Will use %v to determine when file changes", etagHeader)
-			scheme = &etagScheme{}
-		} else {
-			log.Info("Will always assume file changed")
-			scheme = &noopScheme{}
+		c.mu.Lock()
+		next = c.next
+		c.mu.Unlock()
+		if !c.sleepOrDone(ctx, c.wakeTime(next)) {
+			return
 		}
 	}
+}
 
-	err := c.updateFromWeb(scheme)
-	if err != nil {
-		log.Errorf("Unable to update from web: %v", err)
+// wakeTime returns when the loop should next wake to re-check whether next
+// is due: immediately at next outside strict mode, or no later than
+// checkInterval from now in strict mode. Either way, sleepOrDone returns as
+// soon as the loop's context is canceled, so Close never waits out the sleep.
+func (c *urlcache) wakeTime(next time.Time) time.Time {
+	if !c.strict {
+		return next
+	}
+	if poll := time.Now().Add(c.checkInterval); poll.Before(next) {
+		return poll
 	}
-	return scheme
+	return next
 }
 
-func (c *urlcache) updateFromWeb(scheme cacheScheme) error {
-	req, _ := http.NewRequest(http.MethodGet, c.url, nil)
-	scheme.prepareRequest(req)
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("Unable to update from web: %v", err)
+// sleepOrDone waits until until, returning false if ctx is canceled first.
+func (c *urlcache) sleepOrDone(ctx context.Context, until time.Time) bool {
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
-	scheme.onResponse(resp)
+}
 
-	if resp.StatusCode == http.StatusNotModified {
-		return nil
+// nextCheckTime computes when the next revalidation is actually due. In
+// strict mode, a response with usable freshness info is due at the end of
+// its lifetime, however long that is; otherwise (non-strict mode, or no
+// usable freshness info) it's due after checkInterval as before.
+func (c *urlcache) nextCheckTime(fresh freshness) time.Time {
+	if c.strict && !fresh.noStore && fresh.lifetime > 0 {
+		return time.Now().Add(fresh.lifetime)
 	}
+	return time.Now().Add(c.checkInterval)
+}
 
-	defer resp.Body.Close()
+func (c *urlcache) scheduleNext(next time.Time) {
+	if c.onSchedule != nil {
+		c.onSchedule(next)
+	}
+}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("Unable to read data from web: %v", err)
+// forceRefresh runs a single, synchronous revalidation cycle against the
+// origin, updating the stored validators and schedule under c.mu so it's
+// safe to call both from the background loop and from Cache.ForceRefresh.
+// c.mu is held across the whole origin round-trip (including retry backoff
+// sleeps) to serialize concurrent revalidations; lastErr/lastSuccess are
+// published separately under healthMu once the attempt has completed, so
+// LastError/LastSuccess never block on an in-flight refresh.
+func (c *urlcache) forceRefresh(ctx context.Context) error {
+	c.mu.Lock()
+	fresh, err := c.updateFromWeb(ctx, c.validators)
+	c.next = c.nextCheckTime(fresh)
+	c.scheduleNext(c.next)
+	c.mu.Unlock()
+
+	c.healthMu.Lock()
+	c.lastErr = err
+	if err == nil {
+		c.lastSuccess = time.Now()
 	}
-	err = c.onUpdate(bytes.NewReader(data))
-	if err != nil {
-		return err
+	c.healthMu.Unlock()
+
+	return err
+}
+
+// updateFromWeb revalidates against the origin, retrying transient
+// failures (network errors, 5xx, 429) per c.retryPolicy. A non-retryable
+// non-2xx response is reported as an error without touching onUpdate or
+// storage, so callers keep serving whatever was cached before.
+func (c *urlcache) updateFromWeb(ctx context.Context, v *validators) (freshness, error) {
+	attempts := c.retryPolicy.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
 	}
 
-	tmpName, esave := c.saveToTmpFile(data)
-	if esave != nil {
-		log.Infof("Unable to save to temp file, will write directly to destination: %v", esave)
-		f, openErr := os.OpenFile(c.cacheFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-		if openErr != nil {
-			return fmt.Errorf("Unable to open cache file: %v", openErr)
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		fresh, retryable, retryAfter, err := c.attemptUpdateFromWeb(ctx, v)
+		if err == nil {
+			return fresh, nil
+		}
+		lastErr = err
+		if !retryable || attempt == attempts-1 {
+			return fresh, err
+		}
+
+		wait := retryAfter
+		if wait <= 0 {
+			wait = c.retryPolicy.delay(attempt)
+		}
+		log.Infof("Retrying %v after transient error (attempt %v/%v): %v", c.url, attempt+1, attempts, err)
+		if !c.sleepOrDone(ctx, time.Now().Add(wait)) {
+			return freshness{noStore: true}, ctx.Err()
 		}
-		return c.saveToFile(f, data)
 	}
+	return freshness{noStore: true}, lastErr
+}
 
-	err = os.Remove(c.cacheFile)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("Unable to remove old cache file: %v", err)
+// attemptUpdateFromWeb makes a single conditional GET against the origin.
+// It reports whether the failure (if any) is worth retrying, and how long
+// the origin asked callers to wait via Retry-After.
+func (c *urlcache) attemptUpdateFromWeb(ctx context.Context, v *validators) (fresh freshness, retryable bool, retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return freshness{noStore: true}, false, 0, fmt.Errorf("Unable to build request for %v: %v", c.url, err)
 	}
-	err = os.Rename(tmpName, c.cacheFile)
+	v.prepareRequest(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("Unable to move tmpFile to cacheFile: %v", err)
+		return freshness{noStore: true}, true, 0, fmt.Errorf("Unable to update from web: %v", err)
 	}
-	return nil
-}
+	defer resp.Body.Close()
 
-func (c *urlcache) saveToTmpFile(data []byte) (string, error) {
-	tmpFileName := fmt.Sprintf("%v_temp", c.cacheFile)
-	f, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if isRetryableStatus(resp.StatusCode) {
+		wait, _ := parseRetryAfter(resp)
+		return freshness{noStore: true}, true, wait, fmt.Errorf("Server returned %v for %v", resp.StatusCode, c.url)
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		return freshness{noStore: true}, false, 0, fmt.Errorf("Server returned %v for %v", resp.StatusCode, c.url)
+	}
+
+	v.onResponse(resp)
+	fresh = freshnessOf(resp)
+	vary := parseVary(resp.Header.Get(varyHeader))
+	key := c.storageKey(vary, req.Header)
+
+	if resp.StatusCode == http.StatusNotModified {
+		// Confirmed still valid but nothing changed to Put; touch it anyway
+		// so staleness tracking keyed off storage writes (e.g. Manager's
+		// MaxAge) counts this revalidation.
+		if err := c.touchStorage(key); err != nil {
+			return fresh, false, 0, fmt.Errorf("Unable to touch storage entry: %v", err)
+		}
+		return fresh, false, 0, nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("Unable to create temp file %v: %v", tmpFileName, err)
+		return fresh, true, 0, fmt.Errorf("Unable to read data from web: %v", err)
+	}
+	if err := c.onUpdate(bytes.NewReader(data)); err != nil {
+		return fresh, false, 0, err
+	}
+
+	meta := Metadata{ETag: v.etag, LastModified: v.lastModified, Vary: vary}
+	if err := c.putStorage(key, data, meta); err != nil {
+		return fresh, false, 0, fmt.Errorf("Unable to save to storage: %v", err)
 	}
-	return f.Name(), c.saveToFile(f, data)
+	return fresh, false, 0, nil
 }
 
-func (c *urlcache) saveToFile(f *os.File, data []byte) error {
-	defer f.Close()
-	_, err := f.Write(data)
-	if err != nil {
-		return fmt.Errorf("Unable to copy contents from web to temp file: %v", err)
+// putStorage persists data and meta under key, the (possibly Vary-qualified)
+// key this response was actually stored under. When key is a Vary variant
+// of c.cacheKey, it also mirrors the write to c.cacheKey itself, since
+// readInitial always primes from c.cacheKey and has no response in hand yet
+// from which to derive the variant key.
+func (c *urlcache) putStorage(key string, data []byte, meta Metadata) error {
+	if err := c.storage.Put(key, data, meta); err != nil {
+		return err
+	}
+	if key != c.cacheKey {
+		if err := c.storage.Put(c.cacheKey, data, meta); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// lastModified parses the Last-Modified header from a response
-func lastModified(resp *http.Response) (time.Time, error) {
-	return http.ParseTime(resp.Header.Get(lastModifiedHeader))
+// touchStorage is putStorage's Touch counterpart: it touches key and,
+// when key is a Vary variant of c.cacheKey, mirrors the touch to
+// c.cacheKey so its staleness tracking isn't left behind by revalidations
+// that land on the variant entry.
+func (c *urlcache) touchStorage(key string) error {
+	if err := c.storage.Touch(key); err != nil {
+		return err
+	}
+	if key != c.cacheKey {
+		if err := c.storage.Touch(c.cacheKey); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func etag(resp *http.Response) string {
-	return resp.Header.Get(etagHeader)
+// storageKey derives the key to use for storing an entry. When the
+// response declared no Vary, it's just c.cacheKey; otherwise it's
+// c.cacheKey qualified by a hash of the named headers' values on the
+// request that produced the response, so that a url whose representation
+// varies by e.g. Accept-Encoding or Accept-Language doesn't have one
+// variant clobber another's entry.
+func (c *urlcache) storageKey(vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return c.cacheKey
+	}
+	h := sha256.New()
+	for _, name := range vary {
+		fmt.Fprintf(h, "%s=%s\n", name, header.Get(name))
+	}
+	return fmt.Sprintf("%s#%s", c.cacheKey, hex.EncodeToString(h.Sum(nil))[:16])
 }
@@ -1,6 +1,7 @@
 package urlcache
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -33,6 +34,272 @@ func TestCacheByNone(t *testing.T) {
 	})
 }
 
+func TestValidatorsSendsBoth(t *testing.T) {
+	v := &validators{etag: `"abc"`, lastModified: "yesterday"}
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v.prepareRequest(req)
+	assert.Equal(t, `"abc"`, req.Header.Get(ifNoneMatchHeader))
+	assert.Equal(t, "yesterday", req.Header.Get(ifModifiedSinceHeader))
+
+	resp := &http.Response{Header: make(http.Header)}
+	resp.Header.Set(etagHeader, `"def"`)
+	v.onResponse(resp)
+	assert.Equal(t, `"def"`, v.etag)
+	assert.Equal(t, "yesterday", v.lastModified, "a validator missing from the response should be left alone")
+}
+
+func TestParseVary(t *testing.T) {
+	assert.Nil(t, parseVary(""))
+	assert.Nil(t, parseVary("*"))
+	assert.Equal(t, []string{"Accept-Encoding", "Accept-Language"}, parseVary("accept-encoding, Accept-Language"))
+}
+
+func TestFreshnessOf(t *testing.T) {
+	resp := func(headers map[string]string) *http.Response {
+		h := make(http.Header)
+		for k, v := range headers {
+			h.Set(k, v)
+		}
+		return &http.Response{Header: h}
+	}
+
+	fresh := freshnessOf(resp(map[string]string{"Cache-Control": "max-age=60"}))
+	assert.False(t, fresh.noStore)
+	assert.Equal(t, 60*time.Second, fresh.lifetime)
+
+	fresh = freshnessOf(resp(map[string]string{"Cache-Control": "max-age=60, s-maxage=120"}))
+	assert.False(t, fresh.noStore)
+	assert.Equal(t, 120*time.Second, fresh.lifetime)
+
+	fresh = freshnessOf(resp(map[string]string{"Cache-Control": "no-cache"}))
+	assert.True(t, fresh.noStore)
+
+	fresh = freshnessOf(resp(map[string]string{"Cache-Control": "must-revalidate, max-age=60"}))
+	assert.True(t, fresh.noStore)
+
+	fresh = freshnessOf(resp(map[string]string{"Expires": time.Now().Add(1 * time.Hour).Format(http.TimeFormat)}))
+	assert.False(t, fresh.noStore)
+	assert.InDelta(t, time.Hour, fresh.lifetime, float64(5*time.Second))
+
+	fresh = freshnessOf(resp(nil))
+	assert.True(t, fresh.noStore)
+}
+
+func TestMemStorage(t *testing.T) {
+	s := NewMemStorage()
+
+	_, _, err := s.Get("missing")
+	assert.True(t, os.IsNotExist(err))
+
+	meta := Metadata{ETag: "abc", LastModified: "yesterday"}
+	assert.NoError(t, s.Put("key", []byte("hello"), meta))
+
+	rc, gotMeta, err := s.Get("key")
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		assert.Equal(t, meta, gotMeta)
+	}
+
+	assert.NoError(t, s.Delete("key"))
+	_, _, err = s.Get("key")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDirStorage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	s := NewDirStorage(tmpDir)
+	meta := Metadata{ETag: "abc"}
+	assert.NoError(t, s.Put("http://example.com/a", []byte("a-data"), meta))
+	assert.NoError(t, s.Put("http://example.com/b", []byte("b-data"), Metadata{ETag: "def"}))
+
+	rc, gotMeta, err := s.Get("http://example.com/a")
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "a-data", string(b))
+		assert.Equal(t, meta, gotMeta)
+	}
+
+	rc, _, err = s.Get("http://example.com/b")
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "b-data", string(b))
+	}
+}
+
+func TestStorageKeyAvoidsVaryCrossContamination(t *testing.T) {
+	c := &urlcache{cacheKey: "base"}
+
+	plain := c.storageKey(nil, make(http.Header))
+	assert.Equal(t, "base", plain)
+
+	enUS := make(http.Header)
+	enUS.Set("Accept-Language", "en-US")
+	frFR := make(http.Header)
+	frFR.Set("Accept-Language", "fr-FR")
+
+	keyEN := c.storageKey([]string{"Accept-Language"}, enUS)
+	keyFR := c.storageKey([]string{"Accept-Language"}, frFR)
+	assert.NotEqual(t, keyEN, keyFR)
+	assert.NotEqual(t, plain, keyEN)
+
+	assert.Equal(t, keyEN, c.storageKey([]string{"Accept-Language"}, enUS), "same vary headers should map to the same key")
+}
+
+func TestStorageKeyVariantsDontClobberAcrossRestart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	c := &urlcache{cacheKey: "base"}
+	enUS := make(http.Header)
+	enUS.Set("Accept-Language", "en-US")
+	frFR := make(http.Header)
+	frFR.Set("Accept-Language", "fr-FR")
+	keyEN := c.storageKey([]string{"Accept-Language"}, enUS)
+	keyFR := c.storageKey([]string{"Accept-Language"}, frFR)
+
+	s := NewDirStorage(tmpDir)
+	assert.NoError(t, s.Put(keyEN, []byte("en-data"), Metadata{ETag: "en-etag"}))
+	assert.NoError(t, s.Put(keyFR, []byte("fr-data"), Metadata{ETag: "fr-etag"}))
+
+	// Simulate a process restart: a fresh DirStorage over the same dir
+	// should still find each variant under its own key, undisturbed by the
+	// other.
+	restarted := NewDirStorage(tmpDir)
+
+	rc, meta, err := restarted.Get(keyEN)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "en-data", string(b))
+		assert.Equal(t, "en-etag", meta.ETag)
+	}
+
+	rc, meta, err = restarted.Get(keyFR)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "fr-data", string(b))
+		assert.Equal(t, "fr-etag", meta.ETag)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 100 * time.Millisecond, Multiplier: 2, MaxDelay: 300 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, p.delay(0))
+	assert.Equal(t, 200*time.Millisecond, p.delay(1))
+	assert.Equal(t, 300*time.Millisecond, p.delay(2), "delay should be capped at MaxDelay")
+}
+
+func TestRetryRecoversFromTransientErrors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	failuresLeft := 2
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		if failuresLeft > 0 {
+			failuresLeft--
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp.Write([]byte("recovered"))
+	}))
+	defer s.Close()
+
+	lastRead := ""
+	cache, err := Open(s.URL, filepath.Join(tmpDir, "cachefile"), time.Hour, func(r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		lastRead = string(b)
+		mx.Unlock()
+		return nil
+	}, WithRetryPolicy(RetryPolicy{MaxAttempts: 5, InitialDelay: 5 * time.Millisecond, Multiplier: 2}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cache.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, "recovered", lastRead)
+}
+
+func TestNonRetryableErrorLeavesCacheUntouched(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	fail := false
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		shouldFail := fail
+		mx.Unlock()
+		if shouldFail {
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		resp.Write([]byte("good data"))
+	}))
+	defer s.Close()
+
+	lastRead := ""
+	cache, err := Open(s.URL, filepath.Join(tmpDir, "cachefile"), time.Hour, func(r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		lastRead = string(b)
+		mx.Unlock()
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cache.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	mx.Lock()
+	assert.Equal(t, "good data", lastRead)
+	fail = true
+	mx.Unlock()
+
+	err = cache.ForceRefresh(context.Background())
+	assert.Error(t, err)
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, "good data", lastRead, "onUpdate should not be called again for a non-retryable error")
+	assert.Equal(t, err, cache.LastError())
+}
+
 func TestOpenBadURL(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "urlcache_test")
 	if !assert.NoError(t, err) {
@@ -41,13 +308,210 @@ func TestOpenBadURL(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	// Just to make sure it doesn't panic when error happens fetching URL
-	openErr := Open("http://not-exist", filepath.Join(tmpDir, "inter", "cachefile"), 50*time.Millisecond, func(r io.Reader) error {
+	cache, openErr := Open("http://not-exist", filepath.Join(tmpDir, "inter", "cachefile"), 50*time.Millisecond, func(r io.Reader) error {
 		return nil
 	})
 	if !assert.NoError(t, openErr) {
 		return
 	}
 	time.Sleep(150 * time.Millisecond)
+	assert.NoError(t, cache.Close())
+}
+
+func TestCacheCloseStopsRefreshing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	hits := 0
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		hits++
+		mx.Unlock()
+		resp.Write([]byte("data"))
+	}))
+	defer s.Close()
+
+	cache, err := Open(s.URL, filepath.Join(tmpDir, "cachefile"), 20*time.Millisecond, func(r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		return err
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, cache.Close())
+
+	mx.Lock()
+	hitsAtClose := hits
+	mx.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, hitsAtClose, hits, "no more requests should be made after Close")
+}
+
+func TestStrictSkipsConditionalGetWhileFresh(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	hits := 0
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		hits++
+		mx.Unlock()
+		resp.Header().Set(cacheControlHeader, "max-age=3600")
+		resp.Write([]byte("data"))
+	}))
+	defer s.Close()
+
+	var scheduleMx sync.Mutex
+	var scheduled time.Time
+	checkInterval := 10 * time.Millisecond
+
+	cache, err := Open(s.URL, filepath.Join(tmpDir, "cachefile"), checkInterval, func(r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		return err
+	}, Strict(), OnSchedule(func(next time.Time) {
+		scheduleMx.Lock()
+		scheduled = next
+		scheduleMx.Unlock()
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cache.Close()
+
+	// Long enough to cover many checkIntervals, but well short of the
+	// response's 1 hour max-age.
+	time.Sleep(150 * time.Millisecond)
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, 1, hits, "no conditional GET should be issued while the cached response is still fresh")
+
+	scheduleMx.Lock()
+	defer scheduleMx.Unlock()
+	assert.True(t, time.Until(scheduled) > checkInterval,
+		"OnSchedule should report the response's max-age lifetime, not just checkInterval, away")
+}
+
+func TestForceRefresh(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	val := "a"
+	lastRead := ""
+
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		v := val
+		mx.Unlock()
+		resp.Header().Set(etagHeader, v)
+		if req.Header.Get(ifNoneMatchHeader) == v {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Write([]byte(v))
+	}))
+	defer s.Close()
+
+	cache, err := Open(s.URL, filepath.Join(tmpDir, "cachefile"), time.Hour, func(r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		lastRead = string(b)
+		mx.Unlock()
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cache.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	mx.Lock()
+	assert.Equal(t, "a", lastRead)
+	val = "b"
+	mx.Unlock()
+
+	assert.NoError(t, cache.ForceRefresh(context.Background()))
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, "b", lastRead)
+}
+
+func TestVaryEntryPrimesOnRestart(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "urlcache_test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	fullRequests := 0
+
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set(varyHeader, "Accept-Encoding")
+		resp.Header().Set(etagHeader, "v1")
+		if req.Header.Get(ifNoneMatchHeader) == "v1" {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		mx.Lock()
+		fullRequests++
+		mx.Unlock()
+		resp.Write([]byte("data"))
+	}))
+	defer s.Close()
+
+	storage := NewDirStorage(tmpDir)
+	onUpdate := func(r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		return err
+	}
+
+	cache, err := Open(s.URL, "", time.Hour, onUpdate, WithStorage(storage, "greeting"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, cache.Close())
+
+	mx.Lock()
+	assert.Equal(t, 1, fullRequests, "the first open should make exactly one full request")
+	mx.Unlock()
+
+	// Reopening against the same storage and key simulates a process
+	// restart. It should prime from the Vary-qualified entry persisted by
+	// the first open, rather than finding nothing and re-downloading.
+	cache, err = Open(s.URL, "", time.Hour, onUpdate, WithStorage(storage, "greeting"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cache.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, 1, fullRequests, "restart should revalidate with the primed ETag instead of re-downloading")
 }
 
 func doTestCache(t *testing.T, header string, modifiedHeader string, initialVal string, advance func(old string) string) {
@@ -75,7 +539,7 @@ func doTestCache(t *testing.T, header string, modifiedHeader string, initialVal
 	}))
 	defer s.Close()
 
-	openErr := Open(s.URL, filepath.Join(tmpDir, "inter", "cachefile"), 50*time.Millisecond, func(r io.Reader) error {
+	cache, openErr := Open(s.URL, filepath.Join(tmpDir, "inter", "cachefile"), 50*time.Millisecond, func(r io.Reader) error {
 		b, err := ioutil.ReadAll(r)
 		if err != nil {
 			return err
@@ -88,6 +552,7 @@ func doTestCache(t *testing.T, header string, modifiedHeader string, initialVal
 	if !assert.NoError(t, openErr) {
 		return
 	}
+	defer cache.Close()
 
 	// Fetch based on Last-Modified
 	for i := 0; i < 3; i++ {
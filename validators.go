@@ -0,0 +1,151 @@
+package urlcache
+
+import (
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	lastModifiedHeader    = "Last-Modified"
+	ifModifiedSinceHeader = "If-Modified-Since"
+
+	etagHeader        = "ETag"
+	ifNoneMatchHeader = "If-None-Match"
+
+	cacheControlHeader = "Cache-Control"
+	expiresHeader      = "Expires"
+	varyHeader         = "Vary"
+)
+
+// validators holds the cache validators urlcache has seen for a url.
+// RFC 7232 says a client SHOULD send every validator it has on a
+// conditional request, since origins increasingly rotate one while keeping
+// the other stable, so unlike the single-validator scheme types this
+// replaces, validators always sends both when it has them.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+func (v *validators) prepareRequest(req *http.Request) {
+	if v.etag != "" {
+		req.Header.Set(ifNoneMatchHeader, v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set(ifModifiedSinceHeader, v.lastModified)
+	}
+}
+
+func (v *validators) onResponse(resp *http.Response) {
+	if e := resp.Header.Get(etagHeader); e != "" {
+		v.etag = e
+	}
+	if lm := resp.Header.Get(lastModifiedHeader); lm != "" {
+		v.lastModified = lm
+	}
+}
+
+// parseVary extracts the header names named in a Vary response header,
+// canonicalized for use with http.Header.Get. A missing Vary, or one of
+// "*" (which per RFC 7231 means the response can't usefully be cached at
+// all), yields no names.
+func parseVary(header string) []string {
+	if header == "" || header == "*" {
+		return nil
+	}
+	var names []string
+	for _, part := range strings.Split(header, ",") {
+		if name := strings.TrimSpace(part); name != "" {
+			names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// freshness describes how long a response may be served from cache without
+// revalidation, as computed from its Cache-Control/Expires headers.
+type freshness struct {
+	// lifetime is how long, from the time the response was received, the
+	// response may be considered fresh.
+	lifetime time.Duration
+	// noStore indicates that no usable freshness information was found, or
+	// that the response explicitly asked to always be revalidated (e.g.
+	// Cache-Control: no-cache or must-revalidate).
+	noStore bool
+}
+
+// freshnessOf computes the freshness of resp per RFC 7234: Cache-Control's
+// s-maxage/max-age take precedence over Expires, and no-cache/must-revalidate
+// force revalidation on every check regardless of age.
+func freshnessOf(resp *http.Response) freshness {
+	if cc := resp.Header.Get(cacheControlHeader); cc != "" {
+		directives := parseCacheControl(cc)
+		if directives.noCache || directives.mustRevalidate {
+			return freshness{noStore: true}
+		}
+		if directives.hasSMaxAge {
+			return freshness{lifetime: directives.sMaxAge}
+		}
+		if directives.hasMaxAge {
+			return freshness{lifetime: directives.maxAge}
+		}
+	}
+
+	if expires := resp.Header.Get(expiresHeader); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			lifetime := time.Until(t)
+			if lifetime < 0 {
+				lifetime = 0
+			}
+			return freshness{lifetime: lifetime}
+		}
+	}
+
+	return freshness{noStore: true}
+}
+
+// cacheControlDirectives holds the subset of Cache-Control directives that
+// matter for computing freshness.
+type cacheControlDirectives struct {
+	maxAge         time.Duration
+	hasMaxAge      bool
+	sMaxAge        time.Duration
+	hasSMaxAge     bool
+	noCache        bool
+	mustRevalidate bool
+}
+
+// parseCacheControl extracts freshness-related directives from the value of
+// a Cache-Control header.
+func parseCacheControl(header string) cacheControlDirectives {
+	var directives cacheControlDirectives
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		name := part
+		value := ""
+		if idx := strings.Index(part, "="); idx >= 0 {
+			name = strings.TrimSpace(part[:idx])
+			value = strings.Trim(strings.TrimSpace(part[idx+1:]), `"`)
+		}
+		switch strings.ToLower(name) {
+		case "no-cache":
+			directives.noCache = true
+		case "must-revalidate":
+			directives.mustRevalidate = true
+		case "max-age":
+			if secs, err := strconv.Atoi(value); err == nil {
+				directives.maxAge = time.Duration(secs) * time.Second
+				directives.hasMaxAge = true
+			}
+		case "s-maxage":
+			if secs, err := strconv.Atoi(value); err == nil {
+				directives.sMaxAge = time.Duration(secs) * time.Second
+				directives.hasSMaxAge = true
+			}
+		}
+	}
+	return directives
+}